@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MetricSpec declares how a single Riak stat should be collected: which
+// JSON key to read from /stats, what statsd type to emit it as, and an
+// optional name to publish it under instead of the JSON key.
+type MetricSpec struct {
+	Key    string
+	Type   string
+	Rename string
+}
+
+// MetricGroup is a named, independently enable-able set of metrics -- "kv",
+// "search", "pipe", "aae", "consistent", "memory", "system" -- mirroring how
+// Telegraf's riak plugin categorizes stats.
+type MetricGroup struct {
+	Name    string
+	Enabled bool
+	Metrics []MetricSpec
+}
+
+// Config is the set of metric groups loaded from -config.
+type Config struct {
+	Groups []MetricGroup
+}
+
+// ResolvedMetric is a config metric after its rename has been applied: Name
+// is what it's published as, JSONKey is what's read out of /stats.
+type ResolvedMetric struct {
+	JSONKey string
+	Type    string
+}
+
+// Resolve flattens every enabled group's metrics into a map keyed by the
+// published metric name, the shape prepareMetrics collects from.
+func (c *Config) Resolve() map[string]ResolvedMetric {
+	resolved := make(map[string]ResolvedMetric)
+	for _, group := range c.Groups {
+		if !group.Enabled {
+			continue
+		}
+		for _, m := range group.Metrics {
+			name := m.Key
+			if m.Rename != "" {
+				name = m.Rename
+			}
+			resolved[name] = ResolvedMetric{JSONKey: m.Key, Type: m.Type}
+		}
+	}
+	return resolved
+}
+
+// LoadConfig reads a metric group config from path.
+//
+// The format is a restricted, YAML-*like* subset, not a full YAML parser:
+// indentation is fixed at exactly 2/4/6/8 spaces per level (tabs, other
+// widths, quoted scalars and multi-document files are all rejected or
+// mis-parsed), and "#" always starts a comment, even inside a value. It
+// covers exactly the shape below -- anything else should go through a real
+// YAML library instead:
+//
+//	groups:
+//	  kv:
+//	    enabled: true
+//	    metrics:
+//	      - key: node_gets
+//	        type: g
+//	      - key: node_puts
+//	        type: g
+//	        rename: node_puts_renamed
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(f)
+}
+
+func parseConfig(r io.Reader) (*Config, error) {
+	scanner := bufio.NewScanner(r)
+	cfg := &Config{}
+	var group *MetricGroup
+	var metric *MetricSpec
+
+	flushMetric := func() {
+		if metric != nil {
+			group.Metrics = append(group.Metrics, *metric)
+			metric = nil
+		}
+	}
+	flushGroup := func() {
+		flushMetric()
+		if group != nil {
+			cfg.Groups = append(cfg.Groups, *group)
+			group = nil
+		}
+	}
+
+	for scanner.Scan() {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := leadingSpaces(line)
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "groups:":
+			continue
+		case indent == 2 && strings.HasSuffix(trimmed, ":"):
+			flushGroup()
+			group = &MetricGroup{Name: strings.TrimSuffix(trimmed, ":"), Enabled: true}
+		case indent == 4 && strings.HasPrefix(trimmed, "enabled:"):
+			if group == nil {
+				return nil, fmt.Errorf("config: \"enabled\" outside of a group")
+			}
+			group.Enabled = strings.TrimSpace(strings.TrimPrefix(trimmed, "enabled:")) == "true"
+		case indent == 4 && trimmed == "metrics:":
+			if group == nil {
+				return nil, fmt.Errorf("config: \"metrics\" outside of a group")
+			}
+		case indent == 6 && strings.HasPrefix(trimmed, "- "):
+			if group == nil {
+				return nil, fmt.Errorf("config: metric entry outside of a group")
+			}
+			flushMetric()
+			metric = &MetricSpec{}
+			applyField(metric, strings.TrimPrefix(trimmed, "- "))
+		case indent == 8:
+			if metric == nil {
+				return nil, fmt.Errorf("config: metric field %q outside of a metric entry", trimmed)
+			}
+			applyField(metric, trimmed)
+		default:
+			return nil, fmt.Errorf("config: unexpected line %q", trimmed)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flushGroup()
+	return cfg, nil
+}
+
+func applyField(m *MetricSpec, field string) {
+	parts := strings.SplitN(field, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	key := strings.TrimSpace(parts[0])
+	val := strings.TrimSpace(parts[1])
+	switch key {
+	case "key":
+		m.Key = val
+	case "type":
+		m.Type = val
+	case "rename":
+		m.Rename = val
+	}
+}
+
+func leadingSpaces(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+func stripComment(s string) string {
+	if idx := strings.Index(s, "#"); idx >= 0 {
+		return s[:idx]
+	}
+	return s
+}
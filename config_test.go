@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfigResolvesEnabledGroups(t *testing.T) {
+	input := `
+groups:
+  kv:
+    enabled: true
+    metrics:
+      - key: node_gets
+        type: g
+      - key: node_puts
+        type: g
+        rename: node_puts_renamed
+  search:
+    enabled: false
+    metrics:
+      - key: search_query_throughput_one
+        type: g
+`
+	cfg, err := parseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseConfig returned error: %v", err)
+	}
+	if len(cfg.Groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(cfg.Groups))
+	}
+
+	resolved := cfg.Resolve()
+	if len(resolved) != 2 {
+		t.Fatalf("expected 2 resolved metrics from the enabled group, got %d", len(resolved))
+	}
+
+	gets, ok := resolved["node_gets"]
+	if !ok || gets.JSONKey != "node_gets" || gets.Type != "g" {
+		t.Errorf("node_gets not resolved as expected: %+v (ok=%v)", gets, ok)
+	}
+
+	renamed, ok := resolved["node_puts_renamed"]
+	if !ok || renamed.JSONKey != "node_puts" || renamed.Type != "g" {
+		t.Errorf("renamed node_puts not resolved as expected: %+v (ok=%v)", renamed, ok)
+	}
+
+	if _, ok := resolved["search_query_throughput_one"]; ok {
+		t.Errorf("disabled group's metric should not be resolved")
+	}
+}
+
+func TestParseConfigIgnoresComments(t *testing.T) {
+	input := `
+groups:
+  kv: # a comment after the group name
+    enabled: true
+    metrics:
+      - key: node_gets # inline comment
+        type: g
+`
+	cfg, err := parseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseConfig returned error: %v", err)
+	}
+	resolved := cfg.Resolve()
+	if spec, ok := resolved["node_gets"]; !ok || spec.Type != "g" {
+		t.Errorf("expected node_gets to parse cleanly despite comments, got %+v (ok=%v)", spec, ok)
+	}
+}
+
+func TestParseConfigRejectsMetricFieldOutsideEntry(t *testing.T) {
+	input := `
+groups:
+  kv:
+    enabled: true
+    metrics:
+        type: g
+`
+	if _, err := parseConfig(strings.NewReader(input)); err == nil {
+		t.Fatal("expected an error for a metric field with no preceding \"- key:\" entry")
+	}
+}
+
+func TestParseConfigRejectsUnexpectedIndentation(t *testing.T) {
+	input := `
+groups:
+      kv:
+    enabled: true
+`
+	if _, err := parseConfig(strings.NewReader(input)); err == nil {
+		t.Fatal("expected an error for a line at an unsupported indentation width")
+	}
+}
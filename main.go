@@ -1,13 +1,20 @@
 //
 // riak-statsd
-// Sends Riak stats to statsd every 60s.
+// Sends Riak stats to statsd, Prometheus or InfluxDB on a configurable interval.
 //
 // Usage:
-//   -nodename="riak": Riak node name
-//   -riak_host="127.0.0.1": Riak host
-//   -riak_http_port=8098: Riak HTTP port
+//   -riak_hosts="127.0.0.1:8098": Comma-separated list of Riak host:port pairs
+//   -riak_http_port=8098: Default Riak HTTP port for entries in -riak_hosts that omit one
+//   -interval=60s: How often to scrape each Riak node
+//   -http_timeout=4s: Total timeout for a single /stats or /ping request
+//   -response_header_timeout=3s: How long to wait for response headers from Riak before timing out
+//   -max_concurrent_scrapes=8: Maximum number of nodes scraped at once
+//   -config="riak-statsd.yaml": Path to the metric group config file (restricted YAML-like subset, see config.go)
+//   -output="statsd": Output backend: statsd, prometheus or influx
 //   -statsd_host="127.0.0.1": Statsd host
 //   -statsd_port=8125: Statsd host
+//   -prometheus_addr=":9100": Address to serve the Prometheus /metrics endpoint on
+//   -influx_url="http://127.0.0.1:8086/write?db=riak": InfluxDB write endpoint
 
 
 package main
@@ -19,67 +26,245 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-// The interesting metric keys and their statsd types
-var MetricTypes = map[string]string{
-	"node_gets":                    "g",
-	"node_puts":                    "g",
-	"vnode_gets":                   "g",
-	"vnode_puts":                   "g",
-	"read_repairs":                 "g",
-	"read_repairs_total":           "g",
-	"node_get_fsm_objsize_mean":    "g",
-	"node_get_fsm_objsize_median":  "g",
-	"node_get_fsm_objsize_95":      "g",
-	"node_get_fsm_objsize_100":     "g",
-	"node_get_fsm_time_mean":       "ms",
-	"node_get_fsm_time_median":     "ms",
-	"node_get_fsm_time_95":         "ms",
-	"node_get_fsm_time_100":        "ms",
-	"node_put_fsm_time_mean":       "ms",
-	"node_put_fsm_time_median":     "ms",
-	"node_put_fsm_time_95":         "ms",
-	"node_put_fsm_time_100":        "ms",
-	"node_get_fsm_siblings_mean":   "g",
-	"node_get_fsm_siblings_median": "g",
-	"node_get_fsm_siblings_95":     "g",
-	"node_get_fsm_siblings_100":    "g",
-	"memory_processes_used":        "g",
-	"node_get_fsm_active":          "g",
-	"node_get_fsm_active_60s":      "g",
-	"node_get_fsm_in_rate":         "g",
-	"node_get_fsm_out_rate":        "g",
-	"node_get_fsm_rejected":        "g",
-	"node_get_fsm_rejected_60s":    "g",
-	"node_get_fsm_rejected_total":  "g",
-	"node_put_fsm_active":          "g",
-	"node_put_fsm_active_60s":      "g",
-	"node_put_fsm_in_rate":         "g",
-	"node_put_fsm_out_rate":        "g",
-	"node_put_fsm_rejected":        "g",
-	"node_put_fsm_rejected_60s":    "g",
-	"node_put_fsm_rejected_total":  "g",
-	"index_fsm_create":             "g",
-	"index_fsm_create_error":       "g",
-	"index_fsm_active":             "g",
-	"list_fsm_create":              "g",
-	"list_fsm_create_error":        "g",
-	"list_fsm_active":              "g",
-	"sys_process_count":            "g",
-	"coord_redirs_total":           "g",
-	"pbc_connects":                 "g",
-	"pbc_active":                   "g",
-}
-
-func getRiakStats(host string, port int) (*map[string]interface{}, error) {
-	url := fmt.Sprintf("http://%s:%d/stats", host, port)
-	resp, err := http.Get(url)
+const (
+	// minBackoff/maxBackoff bound how long collectNode waits between
+	// retries after a failed scrape.
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// maxConsecutiveFailures is how many scrapes in a row can fail before
+	// a node is marked unhealthy and handed off to the health checker.
+	maxConsecutiveFailures = 3
+
+	// healthCheckInterval is how often an unhealthy node is re-pinged.
+	healthCheckInterval = 10 * time.Second
+)
+
+// RateMetrics are lifetime counters that are more useful to operators as a
+// per-second rate than as an ever-growing total, so instead of passing them
+// through as-is we track the previous scrape's value and emit the delta.
+var RateMetrics = map[string]bool{
+	"node_gets_total": true,
+	"node_puts_total": true,
+}
+
+// Metric is a single Riak stat, tagged with the node it came from and the
+// statsd-style type it should be emitted as ("g", "ms" or "c").
+type Metric struct {
+	Node  string
+	Key   string
+	Value interface{}
+	Type  string
+}
+
+// Emitter ships a batch of metrics to a backend. Implementations must be
+// safe to call once per scrape from a single goroutine; they decide for
+// themselves whether that means pushing over the network or just updating
+// state for something else to pull.
+type Emitter interface {
+	Emit(metrics []Metric) error
+}
+
+// StatsdEmitter writes metrics to statsd over UDP in the wire format this
+// tool has always used: "node.key:value|type".
+type StatsdEmitter struct {
+	conn *net.UDPConn
+}
+
+func NewStatsdEmitter(addr string) (*StatsdEmitter, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdEmitter{conn: conn}, nil
+}
+
+func (e *StatsdEmitter) Emit(metrics []Metric) error {
+	lines := make([]string, len(metrics))
+	for i, m := range metrics {
+		lines[i] = fmt.Sprintf("%s.%s:%v|%s", m.Node, m.Key, m.Value, m.Type)
+	}
+	_, err := e.conn.Write([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		log.Printf("Error sending metrics: %v", err)
+	}
+	return err
+}
+
+// PrometheusEmitter keeps the most recent scrape in memory and serves it on
+// /metrics, with a "# HELP"/"# TYPE" pair per stat as the exposition format
+// requires.
+type PrometheusEmitter struct {
+	mu      sync.Mutex
+	metrics map[string]Metric
+}
+
+func NewPrometheusEmitter(addr string) *PrometheusEmitter {
+	e := &PrometheusEmitter{metrics: make(map[string]Metric)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.handleMetrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Prometheus endpoint failed: %v", err)
+		}
+	}()
+	return e
+}
+
+// Emit merges metrics into the last known value per node+key, so a slow or
+// failing node doesn't blank out the other nodes' series between scrapes.
+func (e *PrometheusEmitter) Emit(metrics []Metric) error {
+	e.mu.Lock()
+	for _, m := range metrics {
+		e.metrics[m.Node+"."+m.Key] = m
+	}
+	e.mu.Unlock()
+	return nil
+}
+
+// handleMetrics groups samples by metric family and writes each family's
+// "# HELP"/"# TYPE" pair exactly once, with every node's sample following --
+// the Prometheus text format rejects a scrape with a repeated HELP/TYPE for
+// the same metric name, which a naive per-sample loop would produce once
+// more than one node is being collected.
+func (e *PrometheusEmitter) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	byKey := make(map[string][]Metric)
+	for _, m := range e.metrics {
+		byKey[m.Key] = append(byKey[m.Key], m)
+	}
+	for key, samples := range byKey {
+		name := fmt.Sprintf("riak_%s", key)
+		fmt.Fprintf(w, "# HELP %s Riak stat %s\n", name, key)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, prometheusType(samples[0].Type))
+		for _, m := range samples {
+			value, ok := toFloat64(m.Value)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s{node=%q} %v\n", name, m.Node, value)
+		}
+	}
+}
+
+func prometheusType(statsdType string) string {
+	if statsdType == "c" {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// InfluxEmitter writes metrics as InfluxDB line protocol to a write
+// endpoint, one "riak" measurement per node with every stat as a field --
+// the same shape Telegraf's riak input produces.
+type InfluxEmitter struct {
+	url    string
+	client *http.Client
+}
+
+func NewInfluxEmitter(url string) *InfluxEmitter {
+	return &InfluxEmitter{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (e *InfluxEmitter) Emit(metrics []Metric) error {
+	byNode := make(map[string][]Metric)
+	for _, m := range metrics {
+		byNode[m.Node] = append(byNode[m.Node], m)
+	}
+	lines := make([]string, 0, len(byNode))
+	for node, nodeMetrics := range byNode {
+		fields := make([]string, 0, len(nodeMetrics))
+		for _, m := range nodeMetrics {
+			value, ok := toFloat64(m.Value)
+			if !ok {
+				continue
+			}
+			fields = append(fields, fmt.Sprintf("%s=%v", m.Key, value))
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("riak,node=%s %s", node, strings.Join(fields, ",")))
+	}
+	resp, err := e.client.Post(e.url, "text/plain", strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		log.Printf("Error writing to InfluxDB: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("InfluxDB write failed: %s", resp.Status))
+	}
+	return nil
+}
+
+// newRiakHTTPClient returns the client shared by every node collector.
+// Timeouts are deliberately tight by default: a hung Riak node must not be
+// able to stall the whole agent.
+func newRiakHTTPClient(timeout time.Duration, responseHeaderTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			ResponseHeaderTimeout: responseHeaderTimeout,
+		},
+	}
+}
+
+// parseRiakHosts turns a comma-separated "-riak_hosts" flag into a list of
+// normalized "host:port" addresses, filling in defaultPort for entries that
+// don't specify one.
+func parseRiakHosts(riakHosts string, defaultPort int) ([]string, error) {
+	var addrs []string
+	for _, entry := range strings.Split(riakHosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, ":") {
+			entry = fmt.Sprintf("%s:%d", entry, defaultPort)
+		}
+		addrs = append(addrs, entry)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no Riak hosts configured")
+	}
+	return addrs, nil
+}
+
+// nodeIdentity derives the tag/prefix used to identify a node's metrics,
+// from its "host:port" address. It keeps the port so co-hosted nodes (e.g.
+// a single-box dev cluster on 8098/8198/...) don't collapse onto the same
+// identity and overwrite each other.
+func nodeIdentity(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Replace(addr, ":", "_", -1)
+	}
+	return fmt.Sprintf("%s_%s", host, port)
+}
+
+func getRiakStats(client *http.Client, addr string) (*map[string]interface{}, error) {
+	url := fmt.Sprintf("http://%s/stats", addr)
+	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -95,9 +280,9 @@ func getRiakStats(host string, port int) (*map[string]interface{}, error) {
 	return &data, nil
 }
 
-func pingRiak(host string, port int) error {
-	url := fmt.Sprintf("http://%s:%d/ping", host, port)
-	resp, err := http.Get(url)
+func pingRiak(client *http.Client, addr string) error {
+	url := fmt.Sprintf("http://%s/ping", addr)
+	resp, err := client.Get(url)
 	if err != nil {
 		return err
 	}
@@ -113,63 +298,254 @@ func pingRiak(host string, port int) error {
 	return nil
 }
 
-func prepareMetrics(nodename string, riakstats map[string]interface{}) *[]string {
-	metrics := make([]string, len(MetricTypes))
-	i := 0
-	for key, st := range MetricTypes {
-		value := riakstats[key]
-		metrics[i] = fmt.Sprintf("%s.%s:%v|%s", nodename, key, value, st)
-		i++
+// rateSample is the last value recorded for a RateTracker key, along with
+// when it was recorded, so the next call can divide by the time that
+// actually elapsed rather than the nominal scrape interval.
+type rateSample struct {
+	value float64
+	at    time.Time
+}
+
+// RateTracker remembers the last value and timestamp seen for each
+// "node.metric" key so RateMetrics can be emitted as a per-second delta
+// instead of a raw total.
+type RateTracker struct {
+	mu   sync.Mutex
+	prev map[string]rateSample
+}
+
+func NewRateTracker() *RateTracker {
+	return &RateTracker{prev: make(map[string]rateSample)}
+}
+
+// Rate records current as the new value for key and returns the per-second
+// rate since the last call, using the actual time elapsed between the two
+// calls -- not a nominal interval -- since backoff and skipped ticks mean
+// scrapes don't always land exactly interval apart. ok is false on the first
+// call for a given key, since there's nothing yet to compute a delta
+// against, and also when current has gone backwards -- a Riak node restart
+// resets its lifetime counters to zero, and a negative "rate" would just be
+// noise on a graph.
+func (r *RateTracker) Rate(key string, current float64, now time.Time) (rate float64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, seen := r.prev[key]
+	r.prev[key] = rateSample{value: current, at: now}
+	if !seen {
+		return 0, false
+	}
+	if current < previous.value {
+		return 0, false
+	}
+	elapsed := now.Sub(previous.at).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return (current - previous.value) / elapsed, true
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func prepareMetrics(node string, riakstats map[string]interface{}, metricTypes map[string]ResolvedMetric, rates *RateTracker) *[]Metric {
+	metrics := make([]Metric, 0, len(metricTypes)+len(RateMetrics))
+	for name, spec := range metricTypes {
+		metrics = append(metrics, Metric{Node: node, Key: name, Value: riakstats[spec.JSONKey], Type: spec.Type})
+	}
+	now := time.Now()
+	for key := range RateMetrics {
+		current, ok := toFloat64(riakstats[key])
+		if !ok {
+			continue
+		}
+		rate, ok := rates.Rate(node+"."+key, current, now)
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, Metric{Node: node, Key: key, Value: rate, Type: "g"})
 	}
 	return &metrics
 }
 
-func sendRiakMetrics(conn *net.UDPConn, metrics *[]string) error {
-	data := []byte(strings.Join(*metrics, "\n"))
-	_, err := conn.Write(data)
+func getAndSendRiakMetrics(client *http.Client, emitter Emitter, metricTypes map[string]ResolvedMetric, rates *RateTracker, node string, addr string) error {
+	data, err := getRiakStats(client, addr)
 	if err != nil {
-		log.Println("Error sending metrics: %v", err)
+		return err
+	}
+	metrics := prepareMetrics(node, *data, metricTypes, rates)
+	if err := emitter.Emit(*metrics); err != nil {
+		log.Printf("[%s] Error emitting metrics: %v", node, err)
 	}
 	return nil
 }
 
-func getAndSendRiakMetrics(conn *net.UDPConn, nodename string, host string, port int) {
-	data, _ := getRiakStats(host, port)
-	if data != nil {
-		metrics := prepareMetrics(nodename, *data)
-		sendRiakMetrics(conn, metrics)
+// nextBackoff doubles the current backoff, capped at maxBackoff.
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > maxBackoff {
+		return maxBackoff
+	}
+	return next
+}
+
+// watchHealth re-pings an unhealthy node every healthCheckInterval and
+// signals recovered once pingRiak succeeds again, then exits.
+func watchHealth(client *http.Client, addr string, recovered chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := pingRiak(client, addr); err == nil {
+				select {
+				case recovered <- struct{}{}:
+				case <-stop:
+				}
+				return
+			}
+		}
+	}
+}
+
+// collectNode scrapes a single Riak node until stop is closed. Scrapes run
+// one at a time within this goroutine -- a slow node just skips ticks rather
+// than piling up concurrent requests -- and sem bounds how many nodes can be
+// mid-scrape across the whole agent at once.
+//
+// A failed scrape is retried with exponential backoff instead of waiting out
+// the full interval; after maxConsecutiveFailures in a row the node is
+// marked unhealthy and left alone until a background health check sees it
+// come back. The first scrape is delayed by a random jitter so a fleet of
+// nodes started together doesn't hit Riak in lockstep on every tick.
+func collectNode(wg *sync.WaitGroup, sem chan struct{}, client *http.Client, emitter Emitter, metricTypes map[string]ResolvedMetric, rates *RateTracker, node string, addr string, interval time.Duration, stop <-chan struct{}) {
+	defer wg.Done()
+
+	jitter := time.Duration(rand.Int63n(int64(interval)))
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+
+	backoff := minBackoff
+	failures := 0
+	healthy := true
+	recovered := make(chan struct{}, 1)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-recovered:
+			healthy = true
+			failures = 0
+			backoff = minBackoff
+			timer.Reset(interval)
+		case <-timer.C:
+			if !healthy {
+				timer.Reset(interval)
+				continue
+			}
+			sem <- struct{}{}
+			err := getAndSendRiakMetrics(client, emitter, metricTypes, rates, node, addr)
+			<-sem
+			if err == nil {
+				failures = 0
+				backoff = minBackoff
+				timer.Reset(interval)
+				continue
+			}
+			failures++
+			log.Printf("[%s] Error getting riak stats (attempt %d): %v", node, failures, err)
+			if failures >= maxConsecutiveFailures {
+				healthy = false
+				log.Printf("[%s] Marking node unhealthy after %d consecutive failures", node, failures)
+				go watchHealth(client, addr, recovered, stop)
+				continue
+			}
+			timer.Reset(backoff)
+			backoff = nextBackoff(backoff)
+		}
+	}
+}
+
+func newEmitter(output string, statsdHost string, statsdPort int, prometheusAddr string, influxURL string) (Emitter, error) {
+	switch output {
+	case "statsd":
+		return NewStatsdEmitter(fmt.Sprintf("%s:%d", statsdHost, statsdPort))
+	case "prometheus":
+		return NewPrometheusEmitter(prometheusAddr), nil
+	case "influx":
+		return NewInfluxEmitter(influxURL), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown output %q, must be statsd, prometheus or influx", output))
 	}
 }
 
 func main() {
+	var output = flag.String("output", "statsd", "Output backend: statsd, prometheus or influx")
 	var statsdHost = flag.String("statsd_host", "127.0.0.1", "Statsd host")
 	var statsdPort = flag.Int("statsd_port", 8125, "Statsd host")
-	var nodename = flag.String("nodename", "riak", "Riak node name")
-	var riakHost = flag.String("riak_host", "127.0.0.1", "Riak host")
-	var riakHttpPort = flag.Int("riak_http_port", 8098, "Riak HTTP port")
+	var prometheusAddr = flag.String("prometheus_addr", ":9100", "Address to serve the Prometheus /metrics endpoint on")
+	var influxURL = flag.String("influx_url", "http://127.0.0.1:8086/write?db=riak", "InfluxDB write endpoint")
+	var riakHosts = flag.String("riak_hosts", "127.0.0.1:8098", "Comma-separated list of Riak host:port pairs")
+	var riakHttpPort = flag.Int("riak_http_port", 8098, "Default Riak HTTP port for entries in -riak_hosts that omit one")
+	var maxConcurrentScrapes = flag.Int("max_concurrent_scrapes", 8, "Maximum number of nodes scraped at once")
+	var configPath = flag.String("config", "riak-statsd.yaml", "Path to the metric group config file (restricted YAML-like subset, see config.go)")
+	var interval = flag.Duration("interval", 60*time.Second, "How often to scrape each Riak node")
+	var httpTimeout = flag.Duration("http_timeout", 4*time.Second, "Total timeout for a single /stats or /ping request")
+	var responseHeaderTimeout = flag.Duration("response_header_timeout", 3*time.Second, "How long to wait for response headers from Riak before timing out")
 	flag.Parse()
 
-	// First ping to node to make sure it works
-	err := pingRiak(*riakHost, *riakHttpPort)
+	if *interval <= 0 {
+		log.Fatalf("Error: -interval must be positive, got %s", *interval)
+		os.Exit(1)
+	}
+
+	addrs, err := parseRiakHosts(*riakHosts, *riakHttpPort)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 		os.Exit(1)
 	}
-	statsd := fmt.Sprintf("%s:%d", *statsdHost, *statsdPort)
-	addr, err := net.ResolveUDPAddr("udp", statsd)
+
+	config, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Couldn't resolve UDP addr: %v", err)
+		log.Fatalf("Error loading config %s: %v", *configPath, err)
 		os.Exit(1)
 	}
-	conn, err := net.DialUDP("udp", nil, addr)
+	metricTypes := config.Resolve()
+
+	client := newRiakHTTPClient(*httpTimeout, *responseHeaderTimeout)
+
+	// Ping every node up front, but a node that's down shouldn't stop us
+	// from collecting from the rest of the cluster.
+	for _, addr := range addrs {
+		if err := pingRiak(client, addr); err != nil {
+			log.Printf("[%s] Error pinging node: %v", addr, err)
+		}
+	}
+
+	emitter, err := newEmitter(*output, *statsdHost, *statsdPort, *prometheusAddr, *influxURL)
 	if err != nil {
-		log.Fatalf("Couldn't connect to statsd at %s", statsd)
+		log.Fatalf("Couldn't set up %s output: %v", *output, err)
 		os.Exit(1)
 	}
 
-	// every 60s run hit the stats endpoint and then send to statsd
-	interval := time.NewTicker(time.Second * 60)
-	for _ = range interval.C {
-		go getAndSendRiakMetrics(conn, *nodename, *riakHost, *riakHttpPort)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *maxConcurrentScrapes)
+	stop := make(chan struct{})
+	rates := NewRateTracker()
+
+	for _, addr := range addrs {
+		wg.Add(1)
+		go collectNode(&wg, sem, client, emitter, metricTypes, rates, nodeIdentity(addr), addr, *interval, stop)
 	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	close(stop)
+	wg.Wait()
 }
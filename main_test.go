@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateTrackerFirstCallHasNoRate(t *testing.T) {
+	r := NewRateTracker()
+	_, ok := r.Rate("riak1.node_gets_total", 100, time.Now())
+	if ok {
+		t.Error("expected ok=false on the first call for a key, nothing to diff against yet")
+	}
+}
+
+func TestRateTrackerComputesRateFromElapsedTime(t *testing.T) {
+	r := NewRateTracker()
+	start := time.Now()
+	r.Rate("riak1.node_gets_total", 100, start)
+
+	rate, ok := r.Rate("riak1.node_gets_total", 150, start.Add(10*time.Second))
+	if !ok {
+		t.Fatal("expected ok=true on the second call")
+	}
+	if rate != 5 {
+		t.Errorf("expected rate 5 ((150-100)/10s), got %v", rate)
+	}
+}
+
+func TestRateTrackerSuppressesNegativeRateOnCounterReset(t *testing.T) {
+	r := NewRateTracker()
+	start := time.Now()
+	r.Rate("riak1.node_gets_total", 200, start)
+
+	// A node restart resets the underlying counter; the drop shouldn't be
+	// reported as a negative rate.
+	rate, ok := r.Rate("riak1.node_gets_total", 50, start.Add(10*time.Second))
+	if ok {
+		t.Errorf("expected ok=false on a counter reset, got rate=%v", rate)
+	}
+
+	// The reset value is still recorded, so the next call rates normally
+	// from the lower baseline.
+	rate, ok = r.Rate("riak1.node_gets_total", 60, start.Add(20*time.Second))
+	if !ok {
+		t.Fatal("expected ok=true once the counter is increasing again")
+	}
+	if rate != 1 {
+		t.Errorf("expected rate 1 ((60-50)/10s), got %v", rate)
+	}
+}